@@ -0,0 +1,71 @@
+// Package dialect adapts gopg's migration runner to a specific database
+// backend, so the same CLI can target PostgreSQL, MySQL, or SQLite.
+package dialect
+
+import "database/sql"
+
+// ConnectionString holds the connection parameters needed to reach a
+// database. Not every field is meaningful for every dialect; each
+// implementation picks what it needs and ignores the rest.
+type ConnectionString struct {
+	Host     string
+	User     string
+	Password string
+	DBName   string
+	Port     int
+	Options  string
+}
+
+// Dialect is implemented by each supported database backend.
+type Dialect interface {
+	// Open establishes a connection to the database described by cs.
+	Open(cs ConnectionString) (*sql.DB, error)
+	// CreateDatabase creates a new database named name using db as the
+	// administrative connection.
+	CreateDatabase(db *sql.DB, name string) error
+	// EnsureVersionTable creates the migrations tracking table if it
+	// does not already exist.
+	EnsureVersionTable(db *sql.DB, tableName string) error
+	// MaxVersion returns the highest migration id recorded in
+	// tableName, or 0 if none have been applied yet.
+	MaxVersion(db *sql.DB, tableName string) (int, error)
+	// InsertVersion records that script (migration id) has been applied,
+	// along with the SHA-256 checksum of its contents.
+	InsertVersion(tx *sql.Tx, tableName string, id int, script string, checksum string) error
+	// DeleteVersion removes the record for a previously-applied
+	// migration id, used when rolling a migration back.
+	DeleteVersion(tx *sql.Tx, tableName string, id int) error
+	// Checksums returns the checksum recorded for every applied
+	// migration id, so they can be verified against what's on disk.
+	Checksums(db *sql.DB, tableName string) (map[int]string, error)
+	// DatabaseMissingErr reports whether err indicates that the target
+	// database does not exist yet.
+	DatabaseMissingErr(err error) bool
+	// AdminDBName returns the name of the database to connect to in order
+	// to create another database, when the target database in cs does
+	// not exist yet. Dialects with no such concept return "".
+	AdminDBName() string
+	// Lock acquires a session-scoped advisory lock keyed by name on conn,
+	// preventing two concurrent runs from applying the same migrations.
+	// conn is a single pinned connection, since the lock (where one
+	// exists) is scoped to the connection that took it: a *sql.DB would
+	// let Lock and Unlock land on different physical connections.
+	// A dialect may implement Lock and Unlock as no-ops, in which case no
+	// lock is taken and concurrent runs are not excluded.
+	Lock(conn *sql.Conn, name string) error
+	// Unlock releases a lock acquired with Lock, on the same conn.
+	Unlock(conn *sql.Conn, name string) error
+}
+
+// byName holds the built-in dialects, keyed by the -driver flag value.
+var byName = map[string]Dialect{
+	"postgres": Postgres{},
+	"mysql":    MySQL{},
+	"sqlite3":  SQLite3{},
+}
+
+// Get looks up a registered dialect by name.
+func Get(name string) (Dialect, bool) {
+	d, ok := byName[name]
+	return d, ok
+}
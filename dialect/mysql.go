@@ -0,0 +1,121 @@
+package dialect
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	_ "github.com/go-sql-driver/mysql"
+)
+
+// MySQL implements Dialect for MySQL/MariaDB, via the go-sql-driver/mysql
+// driver.
+type MySQL struct{}
+
+func (MySQL) Open(cs ConnectionString) (*sql.DB, error) {
+	return sql.Open("mysql", mysqlDSN(cs))
+}
+
+func (MySQL) CreateDatabase(db *sql.DB, name string) error {
+	_, err := db.Exec(fmt.Sprintf("CREATE DATABASE %v", name))
+	return err
+}
+
+func (MySQL) EnsureVersionTable(db *sql.DB, tableName string) error {
+	if _, err := db.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %v(
+		Id integer not null primary key,
+		Script varchar(255),
+		Checksum varchar(64) not null default '',
+		UpgradeDate timestamp not null default current_timestamp);`, tableName)); err != nil {
+		return err
+	}
+
+	// Adopt checksum tracking on a table that predates this column.
+	// MySQL's ADD COLUMN has no portable IF NOT EXISTS, so ignore the
+	// error a table just created above produces instead.
+	_, err := db.Exec(fmt.Sprintf("ALTER TABLE %v ADD COLUMN checksum varchar(64) not null default '';", tableName))
+	if err != nil && strings.Contains(err.Error(), "Duplicate column name") {
+		return nil
+	}
+	return err
+}
+
+func (MySQL) MaxVersion(db *sql.DB, tableName string) (int, error) {
+	var v int
+	err := db.QueryRow(fmt.Sprintf("SELECT COALESCE(MAX(id),0) FROM %v;", tableName)).Scan(&v)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return v, err
+}
+
+func (MySQL) InsertVersion(tx *sql.Tx, tableName string, id int, script string, checksum string) error {
+	_, err := tx.Exec(fmt.Sprintf("INSERT INTO %v(id, script, checksum) values(?, ?, ?);", tableName), id, script, checksum)
+	return err
+}
+
+func (MySQL) DeleteVersion(tx *sql.Tx, tableName string, id int) error {
+	_, err := tx.Exec(fmt.Sprintf("DELETE FROM %v WHERE id = ?;", tableName), id)
+	return err
+}
+
+func (MySQL) Checksums(db *sql.DB, tableName string) (map[int]string, error) {
+	rows, err := db.Query(fmt.Sprintf("SELECT id, checksum FROM %v;", tableName))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sums := map[int]string{}
+	for rows.Next() {
+		var id int
+		var checksum string
+		if err := rows.Scan(&id, &checksum); err != nil {
+			return nil, err
+		}
+		sums[id] = checksum
+	}
+	return sums, rows.Err()
+}
+
+func (MySQL) DatabaseMissingErr(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "Unknown database")
+}
+
+// AdminDBName returns "": MySQL lets a client connect without selecting
+// any database, which is enough to issue CREATE DATABASE.
+func (MySQL) AdminDBName() string {
+	return ""
+}
+
+// Lock and Unlock no-op for MySQL; gopg does not yet use GET_LOCK/
+// RELEASE_LOCK here.
+func (MySQL) Lock(conn *sql.Conn, name string) error   { return nil }
+func (MySQL) Unlock(conn *sql.Conn, name string) error { return nil }
+
+// mysqlDSN renders cs in the go-sql-driver/mysql DSN format.
+func mysqlDSN(cs ConnectionString) string {
+	var auth string
+	if cs.User != "" {
+		auth = cs.User
+		if cs.Password != "" {
+			auth += ":" + cs.Password
+		}
+		auth += "@"
+	}
+
+	host := cs.Host
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	port := cs.Port
+	if port == 0 {
+		port = 3306
+	}
+
+	dsn := fmt.Sprintf("%vtcp(%v:%d)/%v", auth, host, port, cs.DBName)
+	if cs.Options != "" {
+		dsn += "?" + cs.Options
+	}
+	return dsn
+}
@@ -0,0 +1,126 @@
+package dialect
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	_ "github.com/bmizerany/pq"
+)
+
+// Postgres implements Dialect for PostgreSQL, via the bmizerany/pq driver.
+type Postgres struct{}
+
+func (Postgres) Open(cs ConnectionString) (*sql.DB, error) {
+	return sql.Open("postgres", postgresDSN(cs))
+}
+
+func (Postgres) CreateDatabase(db *sql.DB, name string) error {
+	_, err := db.Exec(fmt.Sprintf("CREATE DATABASE %v", name))
+	return err
+}
+
+func (Postgres) EnsureVersionTable(db *sql.DB, tableName string) error {
+	if _, err := db.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %v(
+		Id integer not null primary key,
+		Script varchar(255),
+		Checksum varchar(64) not null default '',
+		UpgradeDate timestamp not null default current_timestamp);`, tableName)); err != nil {
+		return err
+	}
+
+	// ADD COLUMN IF NOT EXISTS adopts checksum tracking on a table that
+	// predates this column, without erroring on one just created above.
+	_, err := db.Exec(fmt.Sprintf("ALTER TABLE %v ADD COLUMN IF NOT EXISTS checksum varchar(64) not null default '';", tableName))
+	return err
+}
+
+func (Postgres) MaxVersion(db *sql.DB, tableName string) (int, error) {
+	var v int
+	err := db.QueryRow(fmt.Sprintf("SELECT COALESCE(MAX(id),0) FROM %v;", tableName)).Scan(&v)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return v, err
+}
+
+func (Postgres) InsertVersion(tx *sql.Tx, tableName string, id int, script string, checksum string) error {
+	_, err := tx.Exec(fmt.Sprintf("INSERT INTO %v(id, script, checksum) values($1, $2, $3);", tableName), id, script, checksum)
+	return err
+}
+
+func (Postgres) DeleteVersion(tx *sql.Tx, tableName string, id int) error {
+	_, err := tx.Exec(fmt.Sprintf("DELETE FROM %v WHERE id = $1;", tableName), id)
+	return err
+}
+
+func (Postgres) Checksums(db *sql.DB, tableName string) (map[int]string, error) {
+	rows, err := db.Query(fmt.Sprintf("SELECT id, checksum FROM %v;", tableName))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sums := map[int]string{}
+	for rows.Next() {
+		var id int
+		var checksum string
+		if err := rows.Scan(&id, &checksum); err != nil {
+			return nil, err
+		}
+		sums[id] = checksum
+	}
+	return sums, rows.Err()
+}
+
+func (Postgres) DatabaseMissingErr(err error) bool {
+	return err != nil && strings.Contains(err.Error(), `database "`) && strings.Contains(err.Error(), "does not exist")
+}
+
+// AdminDBName returns "postgres", the database every PostgreSQL server
+// ships with, used to connect and issue CREATE DATABASE.
+func (Postgres) AdminDBName() string {
+	return "postgres"
+}
+
+// Lock takes a session-level Postgres advisory lock keyed by a hash of
+// name, blocking until it is available. This is used to stop two
+// concurrent runners from applying the same migrations at once. It must
+// run on the same backend connection as the matching Unlock, since the
+// lock is held per-connection; conn pins that connection.
+func (Postgres) Lock(conn *sql.Conn, name string) error {
+	_, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_lock(hashtext($1));", name)
+	return err
+}
+
+func (Postgres) Unlock(conn *sql.Conn, name string) error {
+	_, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock(hashtext($1));", name)
+	return err
+}
+
+// postgresDSN renders cs in the libpq key=value format.
+func postgresDSN(cs ConnectionString) string {
+	var buffer bytes.Buffer
+
+	if cs.Host != "" {
+		buffer.WriteString(fmt.Sprintf("host=%v ", cs.Host))
+	}
+	if cs.User != "" {
+		buffer.WriteString(fmt.Sprintf("user=%v ", cs.User))
+	}
+	if cs.Password != "" {
+		buffer.WriteString(fmt.Sprintf("password=%v ", cs.Password))
+	}
+	if cs.DBName != "" {
+		buffer.WriteString(fmt.Sprintf("dbname=%v ", cs.DBName))
+	}
+	if cs.Port != 0 {
+		buffer.WriteString(fmt.Sprintf("port=%d ", cs.Port))
+	}
+	if cs.Options != "" {
+		buffer.WriteString(cs.Options)
+	}
+	return buffer.String()
+}
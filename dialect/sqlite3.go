@@ -0,0 +1,96 @@
+package dialect
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// SQLite3 implements Dialect for SQLite, via the mattn/go-sqlite3 driver.
+// SQLite has no concept of a separate administrative database, so
+// CreateDatabase and DatabaseMissingErr are no-ops: the file is created the
+// first time it is opened.
+type SQLite3 struct{}
+
+func (SQLite3) Open(cs ConnectionString) (*sql.DB, error) {
+	return sql.Open("sqlite3", cs.DBName)
+}
+
+func (SQLite3) CreateDatabase(db *sql.DB, name string) error {
+	return nil
+}
+
+func (SQLite3) EnsureVersionTable(db *sql.DB, tableName string) error {
+	if _, err := db.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %v(
+		Id integer not null primary key,
+		Script varchar(255),
+		Checksum varchar(64) not null default '',
+		UpgradeDate timestamp not null default current_timestamp);`, tableName)); err != nil {
+		return err
+	}
+
+	// Adopt checksum tracking on a table that predates this column.
+	// SQLite's ADD COLUMN has no IF NOT EXISTS, so ignore the error a
+	// table just created above produces instead.
+	_, err := db.Exec(fmt.Sprintf("ALTER TABLE %v ADD COLUMN checksum varchar(64) not null default '';", tableName))
+	if err != nil && strings.Contains(err.Error(), "duplicate column name") {
+		return nil
+	}
+	return err
+}
+
+func (SQLite3) MaxVersion(db *sql.DB, tableName string) (int, error) {
+	var v int
+	err := db.QueryRow(fmt.Sprintf("SELECT COALESCE(MAX(id),0) FROM %v;", tableName)).Scan(&v)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return v, err
+}
+
+func (SQLite3) InsertVersion(tx *sql.Tx, tableName string, id int, script string, checksum string) error {
+	_, err := tx.Exec(fmt.Sprintf("INSERT INTO %v(id, script, checksum) values(?, ?, ?);", tableName), id, script, checksum)
+	return err
+}
+
+func (SQLite3) DeleteVersion(tx *sql.Tx, tableName string, id int) error {
+	_, err := tx.Exec(fmt.Sprintf("DELETE FROM %v WHERE id = ?;", tableName), id)
+	return err
+}
+
+func (SQLite3) Checksums(db *sql.DB, tableName string) (map[int]string, error) {
+	rows, err := db.Query(fmt.Sprintf("SELECT id, checksum FROM %v;", tableName))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sums := map[int]string{}
+	for rows.Next() {
+		var id int
+		var checksum string
+		if err := rows.Scan(&id, &checksum); err != nil {
+			return nil, err
+		}
+		sums[id] = checksum
+	}
+	return sums, rows.Err()
+}
+
+func (SQLite3) DatabaseMissingErr(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "unable to open database file")
+}
+
+// AdminDBName returns "": SQLite has no administrative database, since
+// CreateDatabase is a no-op.
+func (SQLite3) AdminDBName() string {
+	return ""
+}
+
+// Lock and Unlock no-op for SQLite: a single file-based database is never
+// shared between concurrent migration runners the way a networked
+// database is.
+func (SQLite3) Lock(conn *sql.Conn, name string) error   { return nil }
+func (SQLite3) Unlock(conn *sql.Conn, name string) error { return nil }
@@ -1,197 +1,365 @@
-package main
+// Package gopg is a small SQL migration runner. It is usable both as the
+// gopg CLI (see cmd/gopg) and as a library, so that other Go programs can
+// ship their migrations embedded in their own binary via go:embed and apply
+// them with Run.
+package gopg
 
 import (
-	"bytes"
+	"context"
+	"crypto/sha256"
 	"database/sql"
-	"flag"
+	"encoding/hex"
 	"fmt"
-	_ "github.com/bmizerany/pq"
-	"io/ioutil"
+	"io/fs"
 	"log"
-	"path"
 	"regexp"
+	"sort"
 	"strconv"
-)
+	"strings"
 
-var (
-	scriptsFolder string = "./scripts"
-	cs            ConnectionString
-	help          bool
+	"github.com/w4g3n3r/gopg/dialect"
 )
 
+const defaultVersionTable string = "version"
+
+// Direction selects whether a migration is being applied or rolled back.
+type Direction int
+
 const (
-	versionInsert string = "INSERT INTO version(id, script) values($1, $2);"
+	Up Direction = iota
+	Down
 )
 
+func (d Direction) String() string {
+	if d == Down {
+		return "down"
+	}
+	return "up"
+}
+
+// Upgrade describes a single migration script, or, with Err set, reports
+// that script discovery or execution failed and no further Upgrades will
+// follow on the channel.
 type Upgrade struct {
 	Id      int
 	Script  string
 	Content []byte
+	Err     error
+}
+
+// Options configures a Run.
+type Options struct {
+	// Direction selects whether to apply or roll back migrations.
+	Direction Direction
+	// Target is the version to roll back to. Only used when Direction
+	// is Down.
+	Target int
+	// Force skips the checksum verification pass that otherwise refuses
+	// to run if an already-applied migration has changed on disk.
+	Force bool
+	// TableName is the migrations tracking table, "version" if empty.
+	// Set this so multiple independent apps can track their migrations
+	// in the same database without colliding.
+	TableName string
+	// Schema qualifies TableName, e.g. "app" for "app.version". Left
+	// empty, the table is resolved via the connection's default
+	// search_path/schema.
+	Schema string
+}
+
+// qualifiedTableName resolves opts' TableName/Schema into the fully
+// qualified name of the migrations tracking table.
+func qualifiedTableName(opts Options) string {
+	tableName := opts.TableName
+	if tableName == "" {
+		tableName = defaultVersionTable
+	}
+	if opts.Schema != "" {
+		return opts.Schema + "." + tableName
+	}
+	return tableName
+}
+
+// Init ensures the migrations tracking table exists and reports the
+// database's current version, without applying or rolling back any
+// migrations. It is the library counterpart of `gopg init`.
+func Init(ctx context.Context, d dialect.Dialect, cs dialect.ConnectionString, fsys fs.FS, opts Options) (int, error) {
+	ok, ver := initDb(ctx, d, cs, qualifiedTableName(opts), fsys, opts.Force)
+	if !ok {
+		return 0, fmt.Errorf("gopg: failed to initialize database")
+	}
+	return ver, nil
 }
 
-type ConnectionString struct {
-	Host     string
-	User     string
-	Password string
-	DBName   string
-	Port     int
-	Options  string
+// ScriptStatus describes a single migration script found on disk and
+// whether it has already been applied.
+type ScriptStatus struct {
+	Id      int
+	Script  string
+	Applied bool
 }
 
-func (c ConnectionString) String() string {
-	var buffer bytes.Buffer
+// Status lists the Up migration scripts found in fsys, in ascending id
+// order, noting which ones have already been applied. It does not apply
+// or roll back anything. It is the library counterpart of `gopg status`.
+func Status(ctx context.Context, d dialect.Dialect, cs dialect.ConnectionString, fsys fs.FS, opts Options) ([]ScriptStatus, error) {
+	qualifiedTable := qualifiedTableName(opts)
 
-	if c.Host != "" {
-		buffer.WriteString(fmt.Sprintf("host=%v ", c.Host))
+	db, ok := getDb(d, cs)
+	if !ok {
+		return nil, fmt.Errorf("gopg: failed to open database")
 	}
-	if c.User != "" {
-		buffer.WriteString(fmt.Sprintf("user=%v ", c.User))
+	defer db.Close()
+
+	if err := db.PingContext(ctx); err != nil {
+		return nil, err
 	}
-	if c.Password != "" {
-		buffer.WriteString(fmt.Sprintf("password=%v ", c.Password))
+	if err := d.EnsureVersionTable(db, qualifiedTable); err != nil {
+		return nil, err
 	}
-	if c.DBName != "" {
-		buffer.WriteString(fmt.Sprintf("dbname=%v ", c.DBName))
+
+	applied, err := d.Checksums(db, qualifiedTable)
+	if err != nil {
+		return nil, err
 	}
-	if c.Port != 0 {
-		buffer.WriteString(fmt.Sprintf("port=%d ", c.Port))
+
+	files, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
 	}
-	if c.Options != "" {
-		buffer.WriteString(c.Options)
+
+	re := regexp.MustCompile(`^\d+`)
+	var statuses []ScriptStatus
+	for _, f := range files {
+		name := f.Name()
+		if strings.HasSuffix(name, ".down.sql") {
+			continue
+		}
+		m := re.FindString(name)
+		if m == "" {
+			continue
+		}
+		v, err := strconv.Atoi(m)
+		if err != nil {
+			return nil, err
+		}
+		_, ok := applied[v]
+		statuses = append(statuses, ScriptStatus{Id: v, Script: name, Applied: ok})
 	}
-	return buffer.String()
-}
 
-func init() {
-	flag.StringVar(&cs.DBName, "dbname", "postgres", "Name of the database to manage")
-	flag.StringVar(&cs.Host, "host", "/var/run/postgresql", "Address of the DB host.")
-	flag.StringVar(&cs.Options, "options", "sslmode=disable", "Extra options to pass to postgresql.")
-	flag.StringVar(&cs.Password, "password", "", "Password to use when connecting to the database.")
-	flag.StringVar(&cs.User, "user", "postgres", "User name to use when connecting to the database.")
-	flag.IntVar(&cs.Port, "port", 5432, "The port the host is listening on.")
-	flag.StringVar(&scriptsFolder, "path", "./", "The path containing the upgrade scripts.")
-	flag.BoolVar(&help, "help", false, "Shows this help message.")
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Id < statuses[j].Id })
+	return statuses, nil
 }
 
-func main() {
-	flag.Parse()
-	if help {
-		flag.Usage()
-		return
+// Run applies (or, with opts.Direction set to Down, rolls back) the
+// migration scripts in fsys against the database described by cs, using d
+// as the dialect.
+func Run(ctx context.Context, d dialect.Dialect, cs dialect.ConnectionString, fsys fs.FS, opts Options) error {
+	qualifiedTable := qualifiedTableName(opts)
+
+	lockDb, ok := getDb(d, cs)
+	if !ok {
+		return fmt.Errorf("gopg: failed to open database for migration lock")
+	}
+	defer lockDb.Close()
+
+	// Lock and Unlock must run on the same backend connection, since the
+	// advisory lock some dialects take is scoped to it; a *sql.DB could
+	// hand them different pooled connections and silently never unlock.
+	lockConn, err := lockDb.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("gopg: failed to open connection for migration lock: %w", err)
+	}
+	defer lockConn.Close()
+
+	if err := d.Lock(lockConn, qualifiedTable); err != nil {
+		return fmt.Errorf("gopg: failed to acquire migration lock: %w", err)
 	}
-	init, ver := initDb(cs)
-	if init {
-		log.Print("Initialization complete.")
-		log.Print("Database is at version ", ver)
+	defer d.Unlock(lockConn, qualifiedTable)
 
-		fc := make(chan Upgrade)
-		sc := make(chan Upgrade)
+	ver, err := Init(ctx, d, cs, fsys, opts)
+	if err != nil {
+		return err
+	}
+	log.Print("Database is at version ", ver)
+
+	if opts.Direction == Down && opts.Target >= ver {
+		log.Print("Nothing to roll back; database is already at or below version ", opts.Target)
+		return nil
+	}
 
-		GetUpgradeScripts(scriptsFolder, ver, fc)
-		ExecuteUpgradeScript(cs, fc, sc)
+	fc := make(chan Upgrade)
+	sc := make(chan Upgrade)
 
-		for u := range sc {
-			log.Print("Completed: ", u.Script)
+	GetUpgradeScripts(fsys, ver, opts.Target, opts.Direction, fc)
+	ExecuteUpgradeScript(ctx, d, cs, qualifiedTable, opts.Direction, fc, sc)
+
+	for u := range sc {
+		if u.Err != nil {
+			return u.Err
+		}
+		log.Print("Completed: ", u.Script)
+		if opts.Direction == Down {
+			log.Print("Database is at version ", u.Id-1)
+		} else {
 			log.Print("Database is at version ", u.Id)
 		}
 	}
+	return nil
 }
 
-func ExecuteUpgradeScript(cs ConnectionString, r chan Upgrade, s chan Upgrade) {
+func ExecuteUpgradeScript(ctx context.Context, d dialect.Dialect, cs dialect.ConnectionString, tableName string, direction Direction, r chan Upgrade, s chan Upgrade) {
 	go func() {
-		if db, ok := getDb(cs); ok {
-			defer db.Close()
-
-			for u := range r {
-				log.Print("Running: ", u.Script)
-
-				tx, err := db.Begin()
-
-				ex := func(e error) bool {
-					if e != nil {
-						log.Print(e)
-						log.Print("Upgrade failed on: ", u.Script)
-						if tx != nil {
-							tx.Rollback()
-						}
-						close(s)
-						return true
-					}
-					return false
-				}
-				if ex(err) {
-					return
-				}
+		db, ok := getDb(d, cs)
+		if !ok {
+			s <- Upgrade{Err: fmt.Errorf("gopg: failed to open database for migrations")}
+			close(s)
+			return
+		}
+		defer db.Close()
 
-				if _, err = tx.Exec(versionInsert, u.Id, u.Script); ex(err) {
-					return
-				}
+		for u := range r {
+			if u.Err != nil {
+				s <- u
+				close(s)
+				return
+			}
+
+			log.Print("Running (", direction, "): ", u.Script)
 
-				if _, err = tx.Exec(string(u.Content)); ex(err) {
-					return
+			tx, err := db.BeginTx(ctx, nil)
+
+			ex := func(e error) bool {
+				if e != nil {
+					log.Print(e)
+					log.Print("Migration failed on: ", u.Script)
+					if tx != nil {
+						tx.Rollback()
+					}
+					s <- Upgrade{Err: fmt.Errorf("gopg: migration failed on %v: %w", u.Script, e)}
+					close(s)
+					return true
 				}
+				return false
+			}
+			if ex(err) {
+				return
+			}
 
-				tx.Commit()
-				s <- u
+			if direction == Down {
+				err = d.DeleteVersion(tx, tableName, u.Id)
+			} else {
+				err = d.InsertVersion(tx, tableName, u.Id, u.Script, checksum(u.Content))
 			}
-			close(s)
+			if ex(err) {
+				return
+			}
+
+			if _, err = tx.ExecContext(ctx, string(u.Content)); ex(err) {
+				return
+			}
+
+			tx.Commit()
+			s <- u
 		}
+		close(s)
 	}()
 }
 
-func GetUpgradeScripts(dir string, ver int, s chan Upgrade) {
+// GetUpgradeScripts scans fsys for migration scripts and sends the ones
+// that need to run for direction to s, in the correct order for that
+// direction. For Up, it sends every script with an id greater than ver.
+// For Down, it sends every .down.sql script with an id greater than
+// target and no greater than ver (i.e. one that was actually applied),
+// in descending order. Plain "NNN_name.sql" files (no .up./.down.
+// suffix) are treated as Up-only, for backward compatibility with
+// pre-rollback scripts.
+func GetUpgradeScripts(fsys fs.FS, ver int, target int, direction Direction, s chan Upgrade) {
 	go func() {
 		ex := func(e error) bool {
 			if e != nil {
 				log.Print(e)
+				s <- Upgrade{Err: e}
 				close(s)
 				return true
 			}
 			return false
 		}
 
-		if files, err := ioutil.ReadDir(dir); ex(err) {
+		files, err := fs.ReadDir(fsys, ".")
+		if ex(err) {
 			return
-		} else {
-			re := regexp.MustCompile("^\\d+")
-			for _, f := range files {
-				if m := re.FindString(f.Name()); m != "" {
-					if v, err := strconv.Atoi(m); ex(err) {
-						return
-					} else if v > ver {
-						log.Print("Preparing: ", f.Name())
-						if b, err := ioutil.ReadFile(path.Join(dir, f.Name())); ex(err) {
-							return
-						} else {
-							s <- Upgrade{Id: v, Script: f.Name(), Content: b}
-						}
-					}
+		}
+
+		re := regexp.MustCompile(`^\d+`)
+		var names []string
+
+		for _, f := range files {
+			name := f.Name()
+			isDown := strings.HasSuffix(name, ".down.sql")
+
+			if direction == Down && !isDown {
+				continue
+			}
+			if direction == Up && isDown {
+				continue
+			}
+			if re.FindString(name) == "" {
+				continue
+			}
+			names = append(names, name)
+		}
+
+		if direction == Down {
+			for i, j := 0, len(names)-1; i < j; i, j = i+1, j-1 {
+				names[i], names[j] = names[j], names[i]
+			}
+		}
+
+		for _, name := range names {
+			v, err := strconv.Atoi(re.FindString(name))
+			if ex(err) {
+				return
+			}
+
+			if direction == Down {
+				if v <= target || v > ver {
+					continue
 				}
+			} else if v <= ver {
+				continue
 			}
-			close(s)
+
+			log.Print("Preparing: ", name)
+			b, err := fs.ReadFile(fsys, name)
+			if ex(err) {
+				return
+			}
+			s <- Upgrade{Id: v, Script: name, Content: b}
 		}
+		close(s)
 	}()
 }
 
-func initDb(cs ConnectionString) (bool, int) {
+func initDb(ctx context.Context, d dialect.Dialect, cs dialect.ConnectionString, tableName string, fsys fs.FS, force bool) (bool, int) {
 	log.Print("Initializing database...")
-	if db, ok := getDb(cs); ok {
+	if db, ok := getDb(d, cs); ok {
 		defer db.Close()
 
-		if err := db.Ping(); err != nil {
-			if err.Error() == fmt.Sprintf("pq: database %q does not exist", cs.DBName) {
-				css := ConnectionString{
+		if err := db.PingContext(ctx); err != nil {
+			if d.DatabaseMissingErr(err) {
+				css := dialect.ConnectionString{
 					Host:     cs.Host,
 					User:     cs.User,
-					DBName:   "postgres",
+					DBName:   d.AdminDBName(),
 					Port:     cs.Port,
 					Options:  cs.Options,
 					Password: cs.Password,
 				}
 
-				if createDb(css, cs.DBName) {
+				if createDb(ctx, d, css, cs.DBName) {
 					log.Print("Database created.")
-					return initDb(cs)
+					return initDb(ctx, d, cs, tableName, fsys, force)
 				}
 
 				return false, 0
@@ -201,37 +369,96 @@ func initDb(cs ConnectionString) (bool, int) {
 			}
 		} else {
 			log.Print("Creating version table if not exists.")
-			_, err := db.Exec(`CREATE TABLE IF NOT EXISTS Version(
-				Id integer not null primary key,
-				Script varchar(255),
-				UpgradeDate timestamp not null default current_timestamp);`)
-			if err != nil {
+			if err := d.EnsureVersionTable(db, tableName); err != nil {
 				log.Print(err)
 				return false, 0
 			}
-			if v, err := getVersion(db); err != nil {
+			v, err := d.MaxVersion(db, tableName)
+			if err != nil {
 				log.Print(err)
 				return false, 0
-			} else {
-				return true, v
 			}
+
+			if !force {
+				if err := verifyChecksums(d, db, tableName, fsys, v); err != nil {
+					log.Print(err)
+					return false, 0
+				}
+			}
+
+			return true, v
 		}
 	}
 	return false, 0
 }
 
-func createDb(cs ConnectionString, dbname string) bool {
+// verifyChecksums re-hashes every already-applied script still present in
+// fsys and compares it against the checksum recorded when it was run, so
+// that an edit to an applied migration is caught before new migrations run
+// on top of it.
+func verifyChecksums(d dialect.Dialect, db *sql.DB, tableName string, fsys fs.FS, ver int) error {
+	recorded, err := d.Checksums(db, tableName)
+	if err != nil {
+		return err
+	}
+
+	files, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return err
+	}
+
+	re := regexp.MustCompile(`^\d+`)
+	for _, f := range files {
+		name := f.Name()
+		if strings.HasSuffix(name, ".down.sql") {
+			continue
+		}
+
+		m := re.FindString(name)
+		if m == "" {
+			continue
+		}
+		v, err := strconv.Atoi(m)
+		if err != nil {
+			return err
+		}
+		if v > ver {
+			continue
+		}
+
+		want, ok := recorded[v]
+		if !ok || want == "" {
+			continue
+		}
+
+		b, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		if got := checksum(b); got != want {
+			return fmt.Errorf("gopg: checksum mismatch for %v: an already-applied migration has changed on disk (run with Force/-force to bypass)", name)
+		}
+	}
+	return nil
+}
+
+// checksum returns the hex-encoded SHA-256 of a migration script's content.
+func checksum(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+func createDb(ctx context.Context, d dialect.Dialect, cs dialect.ConnectionString, dbname string) bool {
 	log.Print("Creating database...")
-	if db, ok := getDb(cs); ok {
+	if db, ok := getDb(d, cs); ok {
 		defer db.Close()
 
-		if err := db.Ping(); err != nil {
+		if err := db.PingContext(ctx); err != nil {
 			log.Print(err)
 			return false
 		}
 
-		_, err := db.Exec(fmt.Sprintf("CREATE DATABASE %v", dbname))
-		if err != nil {
+		if err := d.CreateDatabase(db, dbname); err != nil {
 			log.Print(err)
 			return false
 		}
@@ -241,25 +468,11 @@ func createDb(cs ConnectionString, dbname string) bool {
 	return false
 }
 
-func getDb(cs ConnectionString) (*sql.DB, bool) {
-	db, err := sql.Open("postgres", cs.String())
+func getDb(d dialect.Dialect, cs dialect.ConnectionString) (*sql.DB, bool) {
+	db, err := d.Open(cs)
 	if err != nil {
 		log.Print(err)
 		return nil, false
 	}
 	return db, true
 }
-
-func getVersion(db *sql.DB) (int, error) {
-	r := db.QueryRow("SELECT COALESCE(MAX(id),0) FROM version;")
-	var v int
-
-	if err := r.Scan(&v); err != nil {
-		if err == sql.ErrNoRows {
-			return 0, nil
-		} else {
-			return 0, err
-		}
-	}
-	return v, nil
-}